@@ -3,6 +3,7 @@ package actor
 import (
 	"context"
 	"reflect"
+	"sort"
 
 	block "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
@@ -78,7 +79,8 @@ func ReadState(ctx exec.VMContext, st interface{}) error {
 }
 
 // SetKeyValue convenience method to load a lookup, set one key value pair and commit.
-// This function is inefficient when multiple values need to be set into the lookup.
+// This function is inefficient when multiple values need to be set into the lookup; use
+// WithLookupBatch instead in that case.
 func SetKeyValue(ctx context.Context, storage exec.Storage, id cid.Cid, key string, value interface{}) (cid.Cid, error) {
 	lookup, err := LoadLookup(ctx, storage, id)
 	if err != nil {
@@ -119,6 +121,38 @@ func WithLookupForReading(ctx context.Context, storage exec.Storage, id cid.Cid,
 	return f(lookup)
 }
 
+// BatchLookup extends exec.Lookup with primitives for mutating many keys against a single decoded
+// HAMT node before flushing once, so callers updating dozens of entries in one message don't pay
+// the reload-and-flush cost of calling SetKeyValue (or WithLookup) once per key.
+type BatchLookup interface {
+	exec.Lookup
+	// SetMany sets every key-value pair in kvs, without flushing until the lookup is committed.
+	SetMany(ctx context.Context, kvs map[string]interface{}) error
+	// DeleteMany removes every key in keys, without flushing until the lookup is committed.
+	DeleteMany(ctx context.Context, keys []string) error
+	// FindMany returns the values for every key in keys that is present, decoded as valueType (raw
+	// CBOR bytes when valueType is nil). Keys that are
+	// absent are simply omitted from the result rather than causing an error.
+	FindMany(ctx context.Context, keys []string, valueType interface{}) (map[string]interface{}, error)
+}
+
+// WithLookupBatch allows one to read and write many keys of a hamt-ipld node from storage via a
+// callback function, committing once when the callback returns successfully. It is the batch
+// counterpart to WithLookup for actors like the storage-market and power actors that update dozens
+// of entries in a single message.
+func WithLookupBatch(ctx context.Context, storage exec.Storage, id cid.Cid, f func(BatchLookup) error) (cid.Cid, error) {
+	l, err := LoadLookup(ctx, storage, id)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if err = f(l.(BatchLookup)); err != nil {
+		return cid.Undef, err
+	}
+
+	return l.Commit(ctx)
+}
+
 // LoadLookup loads hamt-ipld node from storage if the cid exists, or creates a new one if it is nil.
 // The lookup provides access to a HAMT/CHAMP tree stored in storage.
 func LoadLookup(ctx context.Context, storage exec.Storage, cid cid.Cid) (exec.Lookup, error) {
@@ -169,6 +203,7 @@ type lookup struct {
 }
 
 var _ exec.Lookup = (*lookup)(nil)
+var _ BatchLookup = (*lookup)(nil)
 
 // Find retrieves a value by key
 // If the return value is not primitive, you will need to load the lookup using the LoadTypedLookup
@@ -196,6 +231,79 @@ func (l *lookup) Commit(ctx context.Context) (cid.Cid, error) {
 	return l.s.Put(l.n)
 }
 
+// SetMany sets every key-value pair in kvs against the underlying HAMT node, applying them in
+// sorted key order so repeated splits of the same pointer node happen deterministically, and
+// without flushing between keys. Callers should Commit once all sets are done.
+func (l *lookup) SetMany(ctx context.Context, kvs map[string]interface{}) error {
+	for _, k := range sortedMapKeys(kvs) {
+		if err := l.n.Set(ctx, k, kvs[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMany removes every key in keys from the underlying HAMT node, in sorted order, without
+// flushing between keys. Callers should Commit once all deletes are done.
+func (l *lookup) DeleteMany(ctx context.Context, keys []string) error {
+	for _, k := range sortedStrings(keys) {
+		if err := l.n.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindMany returns the values for every key in keys that is present in the lookup, decoded as
+// valueType, or as raw CBOR bytes when valueType is nil. A missing key is simply omitted from the result rather than causing an error, since a batch of
+// keys read together commonly includes some that were never set.
+func (l *lookup) FindMany(ctx context.Context, keys []string, valueType interface{}) (map[string]interface{}, error) {
+	var vt reflect.Type
+	if valueType != nil {
+		vt = reflect.TypeOf(valueType)
+	}
+
+	out := make(map[string]interface{}, len(keys))
+	for _, k := range sortedStrings(keys) {
+		var deferred cbg.Deferred
+		if err := l.n.Find(ctx, k, &deferred); err != nil {
+			if err == hamt.ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+
+		if vt == nil {
+			out[k] = deferred.Raw
+			continue
+		}
+		to := reflect.New(vt).Interface()
+		if err := cbor.DecodeInto(deferred.Raw, to); err != nil {
+			return nil, err
+		}
+		out[k] = reflect.ValueOf(to).Elem().Interface()
+	}
+	return out, nil
+}
+
+// sortedMapKeys returns the keys of kvs in sorted order.
+func sortedMapKeys(kvs map[string]interface{}) []string {
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedStrings returns a sorted copy of in.
+func sortedStrings(in []string) []string {
+	out := make([]string, len(in))
+	copy(out, in)
+	sort.Strings(out)
+	return out
+}
+
 // IsEmpty returns true if this node contains no key values
 func (l *lookup) IsEmpty() bool {
 	return len(l.n.Pointers) == 0
@@ -0,0 +1,88 @@
+package actor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-filecoin/exec"
+)
+
+var _ exec.Storage = (*memStorage)(nil)
+
+// memStorage is a minimal in-memory exec.Storage, good enough for exercising LoadLookup and
+// WithLookupBatch without a real VM-backed datastore.
+type memStorage struct {
+	blocks map[cid.Cid][]byte
+	head   cid.Cid
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{blocks: make(map[cid.Cid][]byte)}
+}
+
+func (s *memStorage) Put(v interface{}) (cid.Cid, error) {
+	raw, err := cbor.DumpObject(v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	c, err := cbor.CidFromBytes(raw)
+	if err != nil {
+		return cid.Undef, err
+	}
+	s.blocks[c] = raw
+	return c, nil
+}
+
+func (s *memStorage) Get(c cid.Cid) ([]byte, error) {
+	return s.blocks[c], nil
+}
+
+func (s *memStorage) Head() cid.Cid {
+	return s.head
+}
+
+func (s *memStorage) Commit(c cid.Cid, _ cid.Cid) error {
+	s.head = c
+	return nil
+}
+
+func TestWithLookupBatchSetManyDeleteManyFindMany(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+
+	head, err := WithLookupBatch(ctx, storage, cid.Undef, func(l BatchLookup) error {
+		return l.SetMany(ctx, map[string]interface{}{
+			"a": "1",
+			"b": "2",
+			"c": "3",
+		})
+	})
+	require.NoError(t, err)
+	require.NoError(t, storage.Commit(head, storage.Head()))
+
+	var found map[string]interface{}
+	head, err = WithLookupBatch(ctx, storage, head, func(l BatchLookup) error {
+		var err error
+		found, err = l.FindMany(ctx, []string{"a", "b", "missing"}, nil)
+		if err != nil {
+			return err
+		}
+		return l.DeleteMany(ctx, []string{"b"})
+	})
+	require.NoError(t, err)
+	assert.Len(t, found, 2)
+	assert.Contains(t, found, "a")
+	assert.Contains(t, found, "b")
+	assert.NotContains(t, found, "missing")
+
+	err = WithLookupForReading(ctx, storage, head, func(l exec.Lookup) error {
+		var out string
+		return l.Find(ctx, "b", &out)
+	})
+	assert.Error(t, err, "deleted key must no longer be found")
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/go-filecoin/address"
+)
+
+// indexHistoryLimit bounds how many status transitions MessageIndex retains per CID.
+const indexHistoryLimit = 16
+
+// IndexStatus describes one lifecycle state a message tracked by MessageIndex has passed through.
+type IndexStatus int
+
+const (
+	// IndexStatusQueued means the message was accepted into a MessageQueue.
+	IndexStatusQueued IndexStatus = iota
+	// IndexStatusRemoved means the message left its queue, either popped as the expected next
+	// nonce (typically because it was seen included in a block) or dropped by Clear.
+	IndexStatusRemoved
+	// IndexStatusExpired means the message's queue was expired before the message was removed.
+	IndexStatusExpired
+	// IndexStatusRequeued means the message was reinserted at the head of its queue.
+	IndexStatusRequeued
+	// IndexStatusReplaced means the message was dropped from its queue slot in favor of a
+	// replacement message with the same nonce and a higher gas premium.
+	IndexStatusReplaced
+)
+
+// String renders a human-readable name for the status, as used in log lines and CLI output.
+func (s IndexStatus) String() string {
+	switch s {
+	case IndexStatusQueued:
+		return "queued"
+	case IndexStatusRemoved:
+		return "removed"
+	case IndexStatusExpired:
+		return "expired"
+	case IndexStatusRequeued:
+		return "requeued"
+	case IndexStatusReplaced:
+		return "replaced"
+	default:
+		return "unknown"
+	}
+}
+
+// IndexEntry is one recorded status transition for a message, keyed by its CID in MessageIndex.
+type IndexEntry struct {
+	From   address.Address
+	Nonce  uint64
+	Stamp  uint64
+	Status IndexStatus
+}
+
+// MessageIndex answers "what happened to this message?" queries for messages that have passed
+// through a MessageQueue, keyed by message CID. Status transitions are appended rather than
+// overwritten, so a bounded history is retained per CID rather than just the latest state.
+// MessageIndex is safe for concurrent access.
+type MessageIndex struct {
+	lk      sync.RWMutex
+	history map[cid.Cid][]IndexEntry
+}
+
+// NewMessageIndex constructs a new, empty MessageIndex.
+func NewMessageIndex() *MessageIndex {
+	return &MessageIndex{
+		history: make(map[cid.Cid][]IndexEntry),
+	}
+}
+
+// record appends a new status transition for c, trimming the oldest entry once more than
+// indexHistoryLimit have been recorded for it.
+func (mi *MessageIndex) record(c cid.Cid, entry IndexEntry) {
+	mi.lk.Lock()
+	defer mi.lk.Unlock()
+
+	h := append(mi.history[c], entry)
+	if overflow := len(h) - indexHistoryLimit; overflow > 0 {
+		h = h[overflow:]
+	}
+	mi.history[c] = h
+}
+
+// Lookup returns the most recent status transition recorded for c.
+func (mi *MessageIndex) Lookup(ctx context.Context, c cid.Cid) (IndexEntry, bool, error) {
+	mi.lk.RLock()
+	defer mi.lk.RUnlock()
+
+	h := mi.history[c]
+	if len(h) == 0 {
+		return IndexEntry{}, false, nil
+	}
+	return h[len(h)-1], true, nil
+}
+
+// List returns, across all tracked CIDs, the most recent status transition for every message sent
+// by from with a stamp no earlier than sinceStamp. The order of returned entries is not defined.
+func (mi *MessageIndex) List(ctx context.Context, from address.Address, sinceStamp uint64) ([]IndexEntry, error) {
+	mi.lk.RLock()
+	defer mi.lk.RUnlock()
+
+	var out []IndexEntry
+	for _, h := range mi.history {
+		if len(h) == 0 {
+			continue
+		}
+		latest := h[len(h)-1]
+		if latest.From == from && latest.Stamp >= sinceStamp {
+			out = append(out, latest)
+		}
+	}
+	return out, nil
+}
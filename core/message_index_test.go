@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageIndexTracksStatusTransitions(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+
+	removedSender := newTestAddress()
+	removedMsg := newTestMessage(removedSender, 0, 1)
+	require.NoError(t, mq.Enqueue(ctx, removedMsg, 1))
+	removedCid, err := removedMsg.Cid()
+	require.NoError(t, err)
+
+	entry, found, err := mq.Index().Lookup(ctx, removedCid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, IndexStatusQueued, entry.Status)
+
+	_, removedFound, err := mq.RemoveNext(ctx, removedSender, 0)
+	require.NoError(t, err)
+	require.True(t, removedFound)
+
+	entry, found, err = mq.Index().Lookup(ctx, removedCid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, IndexStatusRemoved, entry.Status)
+
+	expiredSender := newTestAddress()
+	expiredMsg := newTestMessage(expiredSender, 0, 1)
+	require.NoError(t, mq.Enqueue(ctx, expiredMsg, 5))
+	expiredCid, err := expiredMsg.Cid()
+	require.NoError(t, err)
+
+	expired := mq.ExpireBefore(ctx, 10)
+	require.Len(t, expired[expiredSender], 1)
+
+	entry, found, err = mq.Index().Lookup(ctx, expiredCid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, IndexStatusExpired, entry.Status)
+
+	replacedSender := newTestAddress()
+	policy := ReplacePolicy{AllowReplace: true, MinPriceBumpPercent: DefaultMinPriceBumpPercent}
+	rbfQueue, err := NewMessageQueue(NewInMemoryMessageQueueStore(), policy, nil, QueueLimits{})
+	require.NoError(t, err)
+	original := newTestMessage(replacedSender, 0, 100)
+	require.NoError(t, rbfQueue.Enqueue(ctx, original, 1))
+	originalCid, err := original.Cid()
+	require.NoError(t, err)
+	require.NoError(t, rbfQueue.Enqueue(ctx, newTestMessage(replacedSender, 0, 200), 2))
+
+	entry, found, err = rbfQueue.Index().Lookup(ctx, originalCid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, IndexStatusReplaced, entry.Status)
+}
+
+func TestMessageIndexList(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+	from := newTestAddress()
+	other := newTestAddress()
+
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 1), 5))
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(other, 0, 1), 5))
+
+	entries, err := mq.Index().List(ctx, from, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, from, entries[0].From)
+
+	// sinceStamp excludes entries recorded before it.
+	entries, err = mq.Index().List(ctx, from, 6)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestMessageIndexHistoryIsBounded(t *testing.T) {
+	mi := NewMessageIndex()
+	c, err := cid.Decode("QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o")
+	require.NoError(t, err)
+
+	for i := 0; i < indexHistoryLimit+5; i++ {
+		mi.record(c, IndexEntry{Nonce: uint64(i), Status: IndexStatusQueued})
+	}
+
+	mi.lk.RLock()
+	history := mi.history[c]
+	mi.lk.RUnlock()
+	require.Len(t, history, indexHistoryLimit)
+	// The oldest entries were trimmed, so the retained history starts at the record that keeps
+	// it exactly indexHistoryLimit long.
+	assert.Equal(t, uint64(5), history[0].Nonce)
+	assert.Equal(t, uint64(indexHistoryLimit+4), history[len(history)-1].Nonce)
+}
+
+func TestLookupByUUID(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+	from := newTestAddress()
+
+	require.NoError(t, mq.EnqueueWithUUID(ctx, newTestMessage(from, 0, 1), 1, "uuid-lookup"))
+
+	qm, found := mq.LookupByUUID("uuid-lookup")
+	require.True(t, found)
+	assert.Equal(t, from, qm.Msg.From)
+
+	_, notFound := mq.LookupByUUID("does-not-exist")
+	assert.False(t, notFound)
+
+	_, removedFound, err := mq.RemoveNext(ctx, from, 0)
+	require.NoError(t, err)
+	require.True(t, removedFound)
+
+	_, found = mq.LookupByUUID("uuid-lookup")
+	assert.False(t, found, "a removed message's UUID must no longer be looked up")
+}
@@ -2,76 +2,488 @@ package core
 
 import (
 	"context"
+	"fmt"
+	"math/big"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/journal"
 	"github.com/filecoin-project/go-filecoin/metrics"
 	"github.com/filecoin-project/go-filecoin/types"
 )
 
+// mqJournalTopic is the journal topic every MessageQueue records its lifecycle events under.
+const mqJournalTopic = "mpool"
+
 var (
-	mqSizeGa   = metrics.NewInt64Gauge("message_queue_size", "The size of the message queue")
-	mqOldestGa = metrics.NewInt64Gauge("message_queue_oldest", "The age of the oldest message in the queue or zero when empty")
-	mqExpireCt = metrics.NewInt64Counter("message_queue_expire", "The number messages expired from the queue")
+	mqSizeGa    = metrics.NewInt64Gauge("message_queue_size", "The size of the message queue")
+	mqOldestGa  = metrics.NewInt64Gauge("message_queue_oldest", "The age of the oldest message in the queue or zero when empty")
+	mqBytesGa   = metrics.NewInt64Gauge("message_queue_bytes", "The total serialized size, in bytes, of every message in the queue")
+	mqExpireCt  = metrics.NewInt64Counter("message_queue_expire", "The number messages expired from the queue")
+	mqReplaceCt = metrics.NewInt64Counter("message_queue_replace", "The number of messages replaced in the queue by a higher-fee message at the same nonce")
+	mqEvictCt   = metrics.NewInt64Counter("message_queue_evict", "The number of messages evicted from the queue to enforce QueueLimits")
 )
 
+// evictedChanBuffer bounds how many eviction batches Evicted() will buffer before new evictions
+// are dropped rather than blocking the mutation that triggered them. A slow or absent consumer can
+// therefore never stall the queue itself.
+const evictedChanBuffer = 16
+
+// QueueLimits bounds how large a MessageQueue is allowed to grow. The zero value, QueueLimits{},
+// imposes no limits at all, preserving the strict-nonce-only contract MessageQueue had before
+// QueueLimits existed. Limits are checked only when Enqueue or EnqueueWithUUID appends a new
+// message; Requeue and replace-by-fee replacements do not check them.
+type QueueLimits struct {
+	// MaxPerSender caps the number of messages any single sender may have queued at once. Zero
+	// means unlimited.
+	MaxPerSender int
+	// MaxTotal caps the number of messages queued across all senders. Zero means unlimited. When
+	// breached, whole per-sender queues are evicted, oldest head stamp first, until the total is
+	// back within the limit, except that the sender of the message whose Enqueue just triggered
+	// enforcement is never itself evicted. A sender whose own queue alone exceeds MaxTotal can
+	// therefore keep the total over the limit until some other sender's eviction catches up, or
+	// until that sender's own messages are removed.
+	MaxTotal int
+	// MaxAgeStamps caps how far a sender's head stamp may fall behind the stamp of the
+	// most-recently-enqueued message, across all senders. Zero means unlimited. As with MaxTotal,
+	// the sender of the message whose Enqueue triggered enforcement is never itself evicted, so
+	// that sender's own head stamp may fall further behind.
+	MaxAgeStamps uint64
+}
+
+// ErrQueueFull is returned by Enqueue and EnqueueWithUUID when accepting a message would breach
+// QueueLimits.MaxPerSender. Sender and HeadStamp let the caller decide whether to bump the gas
+// premium on the sender's head message (see ReplacePolicy) to make room, or simply drop the
+// message.
+type ErrQueueFull struct {
+	Sender    address.Address
+	HeadStamp uint64
+}
+
+func (e *ErrQueueFull) Error() string {
+	return fmt.Sprintf("message queue for %s is full (head stamp %d)", e.Sender, e.HeadStamp)
+}
+
+// QueueStats summarizes the current contents of a MessageQueue for observability, as returned by
+// Stats.
+type QueueStats struct {
+	// PerSender is the number of messages currently queued for each sender with a non-empty queue.
+	PerSender map[address.Address]int
+	// Oldest is the smallest stamp of any queued message, or zero if the queue is empty.
+	Oldest uint64
+	// Newest is the largest stamp of any queued message, or zero if the queue is empty.
+	Newest uint64
+	// TotalBytes is the total serialized size, in bytes, of every queued message.
+	TotalBytes uint64
+}
+
+// DefaultMinPriceBumpPercent is the minimum percentage by which a replacement message's gas
+// premium must exceed the gas premium of the message it replaces.
+const DefaultMinPriceBumpPercent = 25
+
+// ReplacePolicy controls whether Enqueue may replace an already-queued message with a new one at
+// the same nonce ("replace-by-fee"), letting a sender unstick a message with too low a gas
+// premium without waiting for it to expire.
+type ReplacePolicy struct {
+	// AllowReplace enables replace-by-fee. When false, the default, Enqueue keeps the strict
+	// nonce == largest+1 contract and rejects any nonce collision.
+	AllowReplace bool
+	// MinPriceBumpPercent is the minimum percentage by which a replacement's gas premium must
+	// exceed the gas premium of the message it replaces.
+	MinPriceBumpPercent int
+}
+
+// recentUUIDWindow bounds how many recently-removed UUIDs are remembered per sender, so that a
+// resubmission of a message that already left the queue (e.g. because it landed in a block) is
+// recognized as a no-op rather than being re-enqueued.
+const recentUUIDWindow = 64
+
 // MessageQueue stores an ordered list of messages (per actor) and enforces that their nonces form a contiguous sequence.
 // Each message is associated with a "stamp" (an opaque integer), and the queue supports expiring any list
 // of messages where the first message has a stamp below some threshold. The relative order of stamps in a queue is
 // not enforced.
 // A message queue is intended to record outbound messages that have been transmitted but not yet appeared in a block,
 // where the stamp could be block height.
+// Every mutation is first appended to a MessageQueueStore so the queue can be rebuilt after a restart, and is
+// recorded against a MessageIndex keyed by message CID so later code can ask what became of a given message.
 // MessageQueue is safe for concurrent access.
 type MessageQueue struct {
 	lk sync.RWMutex
 	// Message queues keyed by sending actor address, in nonce order
 	queues map[address.Address][]*QueuedMessage
+	// byUUID indexes currently-queued messages by their client-supplied UUID, for those that have one.
+	byUUID map[string]*QueuedMessage
+	// recentUUIDs remembers, per sender, the UUIDs of the last few messages removed from the queue
+	// (via RemoveNext, Clear or ExpireBefore), so a late EnqueueWithUUID retry can be recognized as
+	// already-handled instead of failing the strict nonce check.
+	recentUUIDs map[address.Address][]string
+
+	// store durably records every mutation so the queue can be rebuilt on restart.
+	store MessageQueueStore
+	// index tracks CID-keyed lifecycle history derived from the same mutations.
+	index *MessageIndex
+	// policy governs whether and how Enqueue may replace an already-queued message.
+	policy ReplacePolicy
+	// replaced accumulates messages dropped by replace-by-fee since the last ExpireBefore call,
+	// keyed by sender in the same shape ExpireBefore returns its expired messages. ExpireBefore
+	// drains and merges these into its own return value, so code that already reacts to expired
+	// messages reacts to replacements too, without a second parallel drain API.
+	// Draining only ever happens in memory, so replaying the store on startup must not repopulate
+	// replaced with replacements from before the restart (see replaying); otherwise every restart
+	// would re-report every replacement the queue has ever made, not just the undrained tail.
+	replaced map[address.Address][]*types.SignedMessage
+	// replaying is true while NewMessageQueue is replaying previously-appended records to rebuild
+	// state after a restart, so apply can tell a live walOpReplace (whose displaced message no
+	// caller has seen yet) from a replayed one (whose displacement may already have been drained
+	// and delivered before the crash). The caller must hold mq.lk while reading or writing this.
+	replaying bool
+	// journal records a structured event for every lifecycle transition, or is nil if the queue
+	// was constructed without a journal.JournalBuilder.
+	journal journal.Journal
+	// limits bounds how large the queue may grow. The zero value imposes no limits.
+	limits QueueLimits
+	// evicted delivers the messages dropped by each eviction pass triggered by limits, to callers
+	// reading Evicted().
+	evicted chan []*types.SignedMessage
 }
 
 // QueuedMessage is a message an the stamp it was enqueued with.
 type QueuedMessage struct {
 	Msg   *types.SignedMessage
 	Stamp uint64
+	// UUID is an optional, opaque, client-supplied identifier used to make Enqueue idempotent.
+	UUID string
+	// size caches Msg's serialized size in bytes, computed lazily by byteSize. Zero means not yet
+	// computed (or, harmlessly, that Msg serializes to zero bytes).
+	size uint64
 }
 
-// NewMessageQueue constructs a new, empty queue.
-func NewMessageQueue() *MessageQueue {
-	return &MessageQueue{
-		queues: make(map[address.Address][]*QueuedMessage),
+// byteSize returns qm.Msg's serialized size in bytes, computing and caching it on first use.
+func (qm *QueuedMessage) byteSize() uint64 {
+	if qm.size == 0 && qm.Msg != nil {
+		raw, err := qm.Msg.Marshal()
+		if err == nil {
+			qm.size = uint64(len(raw))
+		}
 	}
+	return qm.size
+}
+
+// NewMessageQueue constructs a new queue backed by store, applying policy to every future
+// Enqueue call. If store already holds records from a previous run, they are replayed in order to
+// rebuild the queues, UUID index and size/oldest gauges before NewMessageQueue returns; replayed
+// events are also re-recorded to the journal against their original timestamp.
+// journalBuilder may be nil, in which case the queue records no journal events, matching prior
+// behavior.
+// limits bounds how large the queue is allowed to grow; the zero value, QueueLimits{}, imposes no
+// limits, matching prior behavior.
+func NewMessageQueue(store MessageQueueStore, policy ReplacePolicy, journalBuilder journal.JournalBuilder, limits QueueLimits) (*MessageQueue, error) {
+	var j journal.Journal
+	if journalBuilder != nil {
+		var err error
+		j, err = journalBuilder(mqJournalTopic)
+		if err != nil {
+			return nil, errors.Wrap(err, "building message queue journal")
+		}
+	}
+
+	mq := &MessageQueue{
+		queues:      make(map[address.Address][]*QueuedMessage),
+		byUUID:      make(map[string]*QueuedMessage),
+		recentUUIDs: make(map[address.Address][]string),
+		store:       store,
+		index:       NewMessageIndex(),
+		policy:      policy,
+		replaced:    make(map[address.Address][]*types.SignedMessage),
+		journal:     j,
+		limits:      limits,
+		evicted:     make(chan []*types.SignedMessage, evictedChanBuffer),
+	}
+
+	records, err := store.LoadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading message queue store")
+	}
+
+	mq.lk.Lock()
+	mq.replaying = true
+	for _, record := range records {
+		mq.apply(record)
+	}
+	mq.replaying = false
+	mq.lk.Unlock()
+
+	ctx := context.Background()
+	mqSizeGa.Set(ctx, mq.Size())
+	mqOldestGa.Set(ctx, int64(mq.Oldest()))
+	mqBytesGa.Set(ctx, mq.TotalBytes())
+
+	return mq, nil
+}
+
+// Close flushes the queue's journal, if any. The store is left open, since callers may continue
+// to use it (e.g. via LoadAll) after the queue itself is done with it.
+func (mq *MessageQueue) Close() error {
+	if mq.journal == nil {
+		return nil
+	}
+	return mq.journal.Close()
+}
+
+// recordJournal emits a structured lifecycle event, unless the queue has no journal.
+func (mq *MessageQueue) recordJournal(at time.Time, operation string, meta ...interface{}) {
+	if mq.journal == nil {
+		return
+	}
+	mq.journal.RecordAt(at, operation, meta...)
+}
+
+// cidOf returns the string form of msg's CID, or "" if it cannot be computed.
+func cidOf(msg *types.SignedMessage) string {
+	c, err := msg.Cid()
+	if err != nil {
+		return ""
+	}
+	return c.String()
+}
+
+// Index returns the MessageIndex recording CID-keyed lifecycle history for messages that have
+// passed through this queue.
+func (mq *MessageQueue) Index() *MessageIndex {
+	return mq.index
 }
 
 // Enqueue appends a new message for an address. If the queue already contains any messages for
 // from same address, the new message's nonce must be exactly one greater than the largest nonce
 // present.
 func (mq *MessageQueue) Enqueue(ctx context.Context, msg *types.SignedMessage, stamp uint64) error {
+	return mq.EnqueueWithUUID(ctx, msg, stamp, "")
+}
+
+// EnqueueWithUUID is like Enqueue, but accepts a client-supplied UUID identifying the message.
+// If a message with the same UUID is already queued, or was recently removed from the queue for
+// this sender (for example because it already appeared in a block), EnqueueWithUUID is a no-op
+// and returns nil without touching the queue or the nonce sequence. This makes resubmission safe
+// for clients retrying across crashes or RPC timeouts. If uuid is empty, behavior is identical to
+// Enqueue.
+func (mq *MessageQueue) EnqueueWithUUID(ctx context.Context, msg *types.SignedMessage, stamp uint64, uuid string) error {
 	defer func() {
 		mqSizeGa.Set(ctx, mq.Size())
 		mqOldestGa.Set(ctx, int64(mq.Oldest()))
+		mqBytesGa.Set(ctx, mq.TotalBytes())
 	}()
 
 	mq.lk.Lock()
 	defer mq.lk.Unlock()
 
+	if uuid != "" {
+		if _, present := mq.byUUID[uuid]; present {
+			return nil
+		}
+		if mq.isRecentlySeen(msg.From, uuid) {
+			return nil
+		}
+	}
+
 	q := mq.queues[msg.From]
 	if len(q) > 0 {
 		nextNonce := q[len(q)-1].Msg.Nonce + 1
 		if msg.Nonce != nextNonce {
+			if existing, idx := findByNonce(q, msg.Nonce); idx >= 0 {
+				return mq.enqueueReplacement(ctx, msg, stamp, uuid, existing)
+			}
+			mq.recordJournal(time.Now(), "enqueue_rejected", "from", msg.From.String(), "nonce", uint64(msg.Nonce), "cid", cidOf(msg), "stamp", stamp, "reason", "nonce_gap")
 			return errors.Errorf("Invalid nonce in %d in enqueue, expected %d", msg.Nonce, nextNonce)
 		}
 	}
-	mq.queues[msg.From] = append(q, &QueuedMessage{msg, stamp})
+
+	if mq.limits.MaxPerSender > 0 && len(q) >= mq.limits.MaxPerSender {
+		var headStamp uint64
+		if len(q) > 0 {
+			headStamp = q[0].Stamp
+		}
+		return &ErrQueueFull{Sender: msg.From, HeadStamp: headStamp}
+	}
+
+	record := WALRecord{Op: walOpEnqueue, Sender: msg.From, Msg: msg, Stamp: stamp, UUID: uuid, At: time.Now()}
+	if err := mq.store.Append(record); err != nil {
+		return errors.Wrap(err, "appending message queue store record")
+	}
+	mq.apply(record)
+	// The sender just granted acceptance above is exempt from eviction here: telling a caller its
+	// Enqueue succeeded and then synchronously evicting that very message would make success
+	// meaningless. Worst case, the queue stays over limit until some other sender's eviction (or
+	// this sender's own future removal) brings it back down.
+	mq.enforceLimitsLocked(ctx, stamp, msg.From)
 	return nil
 }
 
+// findByNonce returns the queued message in q bearing nonce, and its index, or (nil, -1) if none
+// does. q is assumed to be in ascending nonce order.
+func findByNonce(q []*QueuedMessage, nonce types.Uint64) (*QueuedMessage, int) {
+	for i, qm := range q {
+		if qm.Msg.Nonce == nonce {
+			return qm, i
+		}
+	}
+	return nil, -1
+}
+
+// enqueueReplacement replaces existing, an already-queued message with the same nonce as msg,
+// with msg, provided mq.policy allows it and msg's gas premium clears the configured minimum
+// bump over existing's. The caller must hold mq.lk.
+func (mq *MessageQueue) enqueueReplacement(ctx context.Context, msg *types.SignedMessage, stamp uint64, uuid string, existing *QueuedMessage) error {
+	if !mq.policy.AllowReplace {
+		return errors.Errorf("Invalid nonce %d in enqueue, message already queued for that nonce", msg.Nonce)
+	}
+	if !exceedsMinPriceBump(msg.GasPrice.AsBigInt(), existing.Msg.GasPrice.AsBigInt(), mq.policy.MinPriceBumpPercent) {
+		return errors.Errorf("replacement gas premium for nonce %d must exceed queued gas premium by at least %d%%", msg.Nonce, mq.policy.MinPriceBumpPercent)
+	}
+
+	record := WALRecord{Op: walOpReplace, Sender: msg.From, Msg: msg, Stamp: stamp, UUID: uuid, At: time.Now()}
+	if err := mq.store.Append(record); err != nil {
+		return errors.Wrap(err, "appending message queue store record")
+	}
+	mqReplaceCt.Inc(ctx, 1)
+	mq.apply(record)
+	return nil
+}
+
+// exceedsMinPriceBump reports whether newPremium exceeds oldPremium by at least minBumpPercent
+// percent.
+func exceedsMinPriceBump(newPremium, oldPremium *big.Int, minBumpPercent int) bool {
+	scaledNew := new(big.Int).Mul(newPremium, big.NewInt(100))
+	threshold := new(big.Int).Mul(oldPremium, big.NewInt(int64(100+minBumpPercent)))
+	return scaledNew.Cmp(threshold) >= 0
+}
+
+// PromoteBy reports whether sender's head (lowest-nonce) queued message has a gas premium at or
+// above gasPremiumFloor. A selector iterating per-sender queues in nonce order can use this to
+// skip senders whose head message is not worth including in the next block, without having to
+// inspect each sender's full queue itself.
+func (mq *MessageQueue) PromoteBy(sender address.Address, gasPremiumFloor *big.Int) bool {
+	mq.lk.RLock()
+	defer mq.lk.RUnlock()
+	q := mq.queues[sender]
+	if len(q) == 0 {
+		return false
+	}
+	return q[0].Msg.GasPrice.AsBigInt().Cmp(gasPremiumFloor) >= 0
+}
+
+// Pending returns the messages currently queued for sender, in nonce order, for a selector to
+// consider for inclusion in the next block.
+func (mq *MessageQueue) Pending(sender address.Address) []*QueuedMessage {
+	return mq.List(sender)
+}
+
+// Evicted returns the channel on which MessageQueue delivers the messages dropped by each
+// eviction pass triggered by QueueLimits.MaxTotal or QueueLimits.MaxAgeStamps, so upstream code
+// can log or resubmit them. The channel is buffered; an eviction pass that finds it full drops the
+// batch rather than blocking the mutation that triggered it.
+func (mq *MessageQueue) Evicted() <-chan []*types.SignedMessage {
+	return mq.evicted
+}
+
+// Stats summarizes the MessageQueue's current contents for observability.
+func (mq *MessageQueue) Stats() QueueStats {
+	mq.lk.Lock()
+	defer mq.lk.Unlock()
+
+	stats := QueueStats{PerSender: make(map[address.Address]int, len(mq.queues))}
+	oldest := uint64(1<<64 - 1)
+	found := false
+	for sender, q := range mq.queues {
+		if len(q) == 0 {
+			continue
+		}
+		stats.PerSender[sender] = len(q)
+		for _, qm := range q {
+			found = true
+			if qm.Stamp < oldest {
+				oldest = qm.Stamp
+			}
+			if qm.Stamp > stats.Newest {
+				stats.Newest = qm.Stamp
+			}
+			stats.TotalBytes += qm.byteSize()
+		}
+	}
+	if found {
+		stats.Oldest = oldest
+	}
+	return stats
+}
+
+// TotalBytes returns the total serialized size, in bytes, of every message in the MessageQueue,
+// using each QueuedMessage's cached serialized size.
+func (mq *MessageQueue) TotalBytes() int64 {
+	mq.lk.Lock()
+	defer mq.lk.Unlock()
+
+	var total int64
+	for _, q := range mq.queues {
+		for _, qm := range q {
+			total += int64(qm.byteSize())
+		}
+	}
+	return total
+}
+
+// LookupByUUID returns the currently-queued message with the given client-supplied UUID, if any.
+func (mq *MessageQueue) LookupByUUID(uuid string) (*QueuedMessage, bool) {
+	mq.lk.RLock()
+	defer mq.lk.RUnlock()
+	qm, found := mq.byUUID[uuid]
+	return qm, found
+}
+
+// isRecentlySeen reports whether uuid names a message that was removed from sender's queue within
+// the last recentUUIDWindow removals. The caller must hold mq.lk.
+func (mq *MessageQueue) isRecentlySeen(sender address.Address, uuid string) bool {
+	for _, seen := range mq.recentUUIDs[sender] {
+		if seen == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetUUID drops qm's UUID (if any) from the live index and records it in the recently-seen
+// ring for its sender. The caller must hold mq.lk.
+func (mq *MessageQueue) forgetUUID(sender address.Address, qm *QueuedMessage) {
+	if qm.UUID == "" {
+		return
+	}
+	delete(mq.byUUID, qm.UUID)
+
+	recent := append(mq.recentUUIDs[sender], qm.UUID)
+	if overflow := len(recent) - recentUUIDWindow; overflow > 0 {
+		recent = recent[overflow:]
+	}
+	mq.recentUUIDs[sender] = recent
+}
+
+// recordIndex appends a status transition for msg to the index, unless msg's CID cannot be
+// computed (in which case the best-effort index simply omits it).
+func (mq *MessageQueue) recordIndex(sender address.Address, msg *types.SignedMessage, stamp uint64, status IndexStatus) {
+	c, err := msg.Cid()
+	if err != nil {
+		return
+	}
+	mq.index.record(c, IndexEntry{From: sender, Nonce: uint64(msg.Nonce), Stamp: stamp, Status: status})
+}
+
 // Requeue prepends a message for an address. If the queue already contains any messages from the
 // same address, the message's nonce must be exactly one *less than* the smallest nonce present.
 func (mq *MessageQueue) Requeue(ctx context.Context, msg *types.SignedMessage, stamp uint64) error {
 	defer func() {
 		mqSizeGa.Set(ctx, mq.Size())
 		mqOldestGa.Set(ctx, int64(mq.Oldest()))
+		mqBytesGa.Set(ctx, mq.TotalBytes())
 	}()
 
 	mq.lk.Lock()
@@ -84,7 +496,12 @@ func (mq *MessageQueue) Requeue(ctx context.Context, msg *types.SignedMessage, s
 			return errors.Errorf("Invalid nonce %d in requeue, expected %d", msg.Nonce, prevNonce)
 		}
 	}
-	mq.queues[msg.From] = append([]*QueuedMessage{{msg, stamp}}, q...)
+
+	record := WALRecord{Op: walOpRequeue, Sender: msg.From, Msg: msg, Stamp: stamp, At: time.Now()}
+	if err := mq.store.Append(record); err != nil {
+		return errors.Wrap(err, "appending message queue store record")
+	}
+	mq.apply(record)
 	return nil
 }
 
@@ -97,23 +514,35 @@ func (mq *MessageQueue) RemoveNext(ctx context.Context, sender address.Address,
 	defer func() {
 		mqSizeGa.Set(ctx, mq.Size())
 		mqOldestGa.Set(ctx, int64(mq.Oldest()))
+		mqBytesGa.Set(ctx, mq.TotalBytes())
 	}()
 
 	mq.lk.Lock()
 	defer mq.lk.Unlock()
 
 	q := mq.queues[sender]
-	if len(q) > 0 {
-		head := q[0]
-		if expectedNonce == uint64(head.Msg.Nonce) {
-			mq.queues[sender] = q[1:] // pop the head
-			msg = head.Msg
-			found = true
-		} else if expectedNonce > uint64(head.Msg.Nonce) {
-			err = errors.Errorf("Next message for %s has nonce %d, expected %d", sender, head.Msg.Nonce, expectedNonce)
-		}
-		// else expected nonce was before the head of the queue, already removed
+	if len(q) == 0 {
+		return
 	}
+
+	head := q[0]
+	if expectedNonce > uint64(head.Msg.Nonce) {
+		err = errors.Errorf("Next message for %s has nonce %d, expected %d", sender, head.Msg.Nonce, expectedNonce)
+		return
+	}
+	if expectedNonce < uint64(head.Msg.Nonce) {
+		// expected nonce was before the head of the queue, already removed
+		return
+	}
+
+	record := WALRecord{Op: walOpRemoveNext, Sender: sender, Nonce: expectedNonce, At: time.Now()}
+	if appendErr := mq.store.Append(record); appendErr != nil {
+		err = errors.Wrap(appendErr, "appending message queue store record")
+		return
+	}
+	mq.apply(record)
+	msg = head.Msg
+	found = true
 	return
 }
 
@@ -123,22 +552,35 @@ func (mq *MessageQueue) Clear(ctx context.Context, sender address.Address) bool
 	defer func() {
 		mqSizeGa.Set(ctx, mq.Size())
 		mqOldestGa.Set(ctx, int64(mq.Oldest()))
+		mqBytesGa.Set(ctx, mq.TotalBytes())
 	}()
 
 	mq.lk.Lock()
 	defer mq.lk.Unlock()
 
-	q := mq.queues[sender]
-	delete(mq.queues, sender)
-	return len(q) > 0
+	if len(mq.queues[sender]) == 0 {
+		return false
+	}
+
+	record := WALRecord{Op: walOpClear, Sender: sender, At: time.Now()}
+	if err := mq.store.Append(record); err != nil {
+		// The store is the source of truth; if we can't durably record the clear, leave the
+		// in-memory queue untouched rather than diverging from it.
+		return false
+	}
+	mq.apply(record)
+	return true
 }
 
 // ExpireBefore clears the queue of any sender where the first message in the queue has a stamp less than `stamp`.
-// Returns a map containing any expired address queues.
+// Returns a map containing any expired address queues, merged with any messages replace-by-fee has
+// dropped since the last ExpireBefore call, so a caller already reacting to expired messages reacts
+// to replacements too.
 func (mq *MessageQueue) ExpireBefore(ctx context.Context, stamp uint64) map[address.Address][]*types.SignedMessage {
 	defer func() {
 		mqSizeGa.Set(ctx, mq.Size())
 		mqOldestGa.Set(ctx, int64(mq.Oldest()))
+		mqBytesGa.Set(ctx, mq.TotalBytes())
 	}()
 
 	mq.lk.Lock()
@@ -147,20 +589,217 @@ func (mq *MessageQueue) ExpireBefore(ctx context.Context, stamp uint64) map[addr
 	expired := make(map[address.Address][]*types.SignedMessage)
 
 	for sender, q := range mq.queues {
-		if len(q) > 0 && q[0].Stamp < stamp {
+		if len(q) == 0 || q[0].Stamp >= stamp {
+			continue
+		}
 
-			// record the number of messages to be expired
-			mqExpireCt.Inc(ctx, int64(len(q)))
-			for _, m := range q {
-				expired[sender] = append(expired[sender], m.Msg)
-			}
+		record := WALRecord{Op: walOpExpireBefore, Sender: sender, Threshold: stamp, At: time.Now()}
+		if err := mq.store.Append(record); err != nil {
+			// Leave this sender's queue in place; it will be retried on the next ExpireBefore call.
+			continue
+		}
 
-			mq.queues[sender] = []*QueuedMessage{}
+		mqExpireCt.Inc(ctx, int64(len(q)))
+		for _, m := range q {
+			expired[sender] = append(expired[sender], m.Msg)
 		}
+		mq.apply(record)
 	}
+
+	for sender, msgs := range mq.replaced {
+		expired[sender] = append(expired[sender], msgs...)
+	}
+	mq.replaced = make(map[address.Address][]*types.SignedMessage)
+
 	return expired
 }
 
+// apply mutates the in-memory queue state and index to reflect a record already durably appended
+// to the store, used both when a live call just wrote the record and when replaying the store on
+// startup. The caller must hold mq.lk.
+func (mq *MessageQueue) apply(record WALRecord) {
+	switch record.Op {
+	case walOpEnqueue:
+		qm := &QueuedMessage{Msg: record.Msg, Stamp: record.Stamp, UUID: record.UUID}
+		mq.queues[record.Sender] = append(mq.queues[record.Sender], qm)
+		if record.UUID != "" {
+			mq.byUUID[record.UUID] = qm
+		}
+		mq.recordIndex(record.Sender, record.Msg, record.Stamp, IndexStatusQueued)
+		mq.recordJournal(record.At, "enqueue", "from", record.Sender.String(), "nonce", uint64(record.Msg.Nonce), "cid", cidOf(record.Msg), "stamp", record.Stamp)
+
+	case walOpRequeue:
+		qm := &QueuedMessage{Msg: record.Msg, Stamp: record.Stamp}
+		mq.queues[record.Sender] = append([]*QueuedMessage{qm}, mq.queues[record.Sender]...)
+		mq.recordIndex(record.Sender, record.Msg, record.Stamp, IndexStatusRequeued)
+		mq.recordJournal(record.At, "requeue", "from", record.Sender.String(), "nonce", uint64(record.Msg.Nonce), "cid", cidOf(record.Msg), "stamp", record.Stamp)
+
+	case walOpRemoveNext:
+		q := mq.queues[record.Sender]
+		if len(q) == 0 {
+			return
+		}
+		head := q[0]
+		mq.queues[record.Sender] = q[1:]
+		mq.forgetUUID(record.Sender, head)
+		mq.recordIndex(record.Sender, head.Msg, head.Stamp, IndexStatusRemoved)
+		mq.recordJournal(record.At, "remove", "from", record.Sender.String(), "nonce", uint64(head.Msg.Nonce), "cid", cidOf(head.Msg), "stamp", head.Stamp)
+
+	case walOpClear:
+		q := mq.queues[record.Sender]
+		delete(mq.queues, record.Sender)
+		for _, qm := range q {
+			mq.forgetUUID(record.Sender, qm)
+			mq.recordIndex(record.Sender, qm.Msg, qm.Stamp, IndexStatusRemoved)
+		}
+		mq.recordJournal(record.At, "clear", "from", record.Sender.String())
+
+	case walOpExpireBefore:
+		q := mq.queues[record.Sender]
+		delete(mq.queues, record.Sender)
+		for _, qm := range q {
+			mq.forgetUUID(record.Sender, qm)
+			mq.recordIndex(record.Sender, qm.Msg, qm.Stamp, IndexStatusExpired)
+		}
+		mq.recordJournal(record.At, "expire", "from", record.Sender.String(), "stamp", record.Threshold, "reason", "expired")
+
+	case walOpReplace:
+		q := mq.queues[record.Sender]
+		for i, existing := range q {
+			if existing.Msg.Nonce != record.Msg.Nonce {
+				continue
+			}
+			mq.forgetUUID(record.Sender, existing)
+			mq.recordIndex(record.Sender, existing.Msg, existing.Stamp, IndexStatusReplaced)
+
+			qm := &QueuedMessage{Msg: record.Msg, Stamp: record.Stamp, UUID: record.UUID}
+			q[i] = qm
+			if record.UUID != "" {
+				mq.byUUID[record.UUID] = qm
+			}
+			mq.recordIndex(record.Sender, record.Msg, record.Stamp, IndexStatusQueued)
+			if !mq.replaying {
+				mq.replaced[record.Sender] = append(mq.replaced[record.Sender], existing.Msg)
+			}
+			mq.recordJournal(record.At, "replace", "from", record.Sender.String(), "nonce", uint64(record.Msg.Nonce), "cid", cidOf(existing.Msg), "stamp", existing.Stamp,
+				"reason", fmt.Sprintf("replaced_by=%s", cidOf(record.Msg)))
+			break
+		}
+	}
+}
+
+// enforceLimitsLocked evicts whole per-sender queues as needed to bring the MessageQueue back
+// within mq.limits after a successful Enqueue, oldest head stamp first, and delivers whatever was
+// evicted on mq.evicted. stamp is the stamp of the message that was just enqueued, used as "now"
+// when enforcing MaxAgeStamps. protect is the sender that was just granted acceptance and so is
+// never itself evicted by this pass. The caller must hold mq.lk.
+func (mq *MessageQueue) enforceLimitsLocked(ctx context.Context, stamp uint64, protect address.Address) {
+	if mq.limits.MaxAgeStamps > 0 && stamp > mq.limits.MaxAgeStamps {
+		mq.evictOlderThanLocked(ctx, stamp-mq.limits.MaxAgeStamps, protect)
+	}
+	if mq.limits.MaxTotal > 0 {
+		for mq.totalLocked() > mq.limits.MaxTotal {
+			if !mq.evictOldestSenderLocked(ctx, protect) {
+				break
+			}
+		}
+	}
+}
+
+// evictOlderThanLocked evicts every sender other than protect whose head message has a stamp below
+// threshold. The caller must hold mq.lk.
+func (mq *MessageQueue) evictOlderThanLocked(ctx context.Context, threshold uint64, protect address.Address) {
+	for sender, q := range mq.queues {
+		if sender == protect {
+			continue
+		}
+		if len(q) > 0 && q[0].Stamp < threshold {
+			mq.evictSenderLocked(ctx, sender)
+		}
+	}
+}
+
+// evictOldestSenderLocked evicts the sender other than protect whose head message has the smallest
+// stamp, returning false if no such sender has a non-empty queue. The caller must hold mq.lk.
+func (mq *MessageQueue) evictOldestSenderLocked(ctx context.Context, protect address.Address) bool {
+	sender, ok := mq.oldestHeadSenderLocked(protect)
+	if !ok {
+		return false
+	}
+	return mq.evictSenderLocked(ctx, sender)
+}
+
+// evictSenderLocked evicts sender's entire queue to enforce QueueLimits, reusing the same
+// walOpClear machinery Clear uses so the eviction is durable and reflected in the index. Evicted
+// messages are delivered on mq.evicted rather than returned, since eviction (unlike Clear) is not
+// driven by a direct caller. Returns false if sender's queue was already empty or the eviction
+// could not be durably recorded. The caller must hold mq.lk.
+func (mq *MessageQueue) evictSenderLocked(ctx context.Context, sender address.Address) bool {
+	q := mq.queues[sender]
+	if len(q) == 0 {
+		return false
+	}
+
+	record := WALRecord{Op: walOpClear, Sender: sender, At: time.Now()}
+	if err := mq.store.Append(record); err != nil {
+		// Leave this sender's queue in place; it will be retried on the next enforceLimitsLocked call.
+		return false
+	}
+
+	msgs := make([]*types.SignedMessage, len(q))
+	for i, qm := range q {
+		msgs[i] = qm.Msg
+	}
+	mqEvictCt.Inc(ctx, int64(len(q)))
+	mq.apply(record)
+	mq.pushEvicted(msgs)
+	return true
+}
+
+// oldestHeadSenderLocked returns the sender, other than protect, whose queue's head message has
+// the smallest stamp, or false if no such sender has a non-empty queue. The caller must hold mq.lk.
+func (mq *MessageQueue) oldestHeadSenderLocked(protect address.Address) (address.Address, bool) {
+	var oldestSender address.Address
+	oldestStamp := uint64(1<<64 - 1)
+	found := false
+	for sender, q := range mq.queues {
+		if sender == protect {
+			continue
+		}
+		if len(q) == 0 {
+			continue
+		}
+		if q[0].Stamp < oldestStamp {
+			oldestStamp = q[0].Stamp
+			oldestSender = sender
+			found = true
+		}
+	}
+	return oldestSender, found
+}
+
+// totalLocked returns the total number of messages queued across all senders. The caller must
+// hold mq.lk.
+func (mq *MessageQueue) totalLocked() int {
+	var total int
+	for _, q := range mq.queues {
+		total += len(q)
+	}
+	return total
+}
+
+// pushEvicted delivers msgs on mq.evicted, dropping them if the channel's buffer is full so a slow
+// or absent consumer can never stall the mutation that triggered the eviction.
+func (mq *MessageQueue) pushEvicted(msgs []*types.SignedMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	select {
+	case mq.evicted <- msgs:
+	default:
+	}
+}
+
 // LargestNonce returns the largest nonce of any message in the queue for an address.
 // If the queue for the address is empty, returns (0, false).
 func (mq *MessageQueue) LargestNonce(sender address.Address) (largest uint64, found bool) {
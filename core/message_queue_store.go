@@ -0,0 +1,169 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/pkg/errors"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+// Write-ahead log operation kinds recorded in a WALRecord.
+const (
+	walOpEnqueue      = "enqueue"
+	walOpRequeue      = "requeue"
+	walOpRemoveNext   = "remove"
+	walOpClear        = "clear"
+	walOpExpireBefore = "expire"
+	walOpReplace      = "replace"
+)
+
+// WALRecord is a single write-ahead log entry describing one mutation applied to a MessageQueue.
+// NewMessageQueue replays a sequence of WALRecords, in the order they were appended, to rebuild
+// its in-memory state after a restart.
+type WALRecord struct {
+	Op     string
+	Sender address.Address
+	Msg    *types.SignedMessage `json:",omitempty"`
+	Stamp  uint64               `json:",omitempty"`
+	UUID   string               `json:",omitempty"`
+	// Nonce carries the expected nonce for a walOpRemoveNext record.
+	Nonce uint64 `json:",omitempty"`
+	// Threshold carries the stamp threshold that triggered a walOpExpireBefore record.
+	Threshold uint64 `json:",omitempty"`
+	// At is the wall-clock time the mutation was applied, so a replayed journal event can be
+	// recorded against the time it actually happened rather than the time it was replayed.
+	At time.Time `json:",omitempty"`
+}
+
+// MessageQueueStore persists the sequence of operations applied to a MessageQueue so that its
+// state survives a node restart. NewMessageQueue treats a store as the source of truth: every
+// Enqueue, Requeue, RemoveNext, Clear and ExpireBefore appends a record before the corresponding
+// in-memory mutation is made.
+type MessageQueueStore interface {
+	// Append durably records a single queue mutation. Implementations must make the record
+	// durable (e.g. fsync'd) before returning, so a crash immediately after Append cannot lose it.
+	Append(record WALRecord) error
+	// LoadAll replays every record written so far, in append order.
+	LoadAll() ([]WALRecord, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// NewInMemoryMessageQueueStore returns a MessageQueueStore backed by a slice held in memory. It
+// does not survive a process restart, and is intended for tests that exercise MessageQueue's
+// transactional behavior without needing a real on-disk store.
+func NewInMemoryMessageQueueStore() MessageQueueStore {
+	return &inMemoryMessageQueueStore{}
+}
+
+type inMemoryMessageQueueStore struct {
+	lk      sync.Mutex
+	records []WALRecord
+}
+
+func (s *inMemoryMessageQueueStore) Append(record WALRecord) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *inMemoryMessageQueueStore) LoadAll() ([]WALRecord, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	out := make([]WALRecord, len(s.records))
+	copy(out, s.records)
+	return out, nil
+}
+
+func (s *inMemoryMessageQueueStore) Close() error {
+	return nil
+}
+
+// messageQueueRecordsBucket is the single bbolt bucket a boltMessageQueueStore keeps its records
+// in, keyed by an auto-incrementing, big-endian-encoded sequence number so a cursor scan of the
+// bucket replays them in append order.
+var messageQueueRecordsBucket = []byte("records")
+
+// NewBoltMessageQueueStore returns the default, on-disk MessageQueueStore: a BoltDB-backed log at
+// path, whose records are keyed by sequence number in a single bucket so LoadAll can replay them
+// via an indexed cursor scan rather than re-parsing an ever-growing flat file, and whose writes are
+// each committed in their own fsync'd bolt transaction so a crash cannot lose an
+// already-acknowledged mutation. BoltDB's MVCC also lets LoadAll run concurrently with Append
+// without blocking either side. This plays the same durability role for outbound messages that
+// Lotus's msgindex plays for its mpool.
+func NewBoltMessageQueueStore(path string) (MessageQueueStore, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening message queue store %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(messageQueueRecordsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "initializing message queue store %s", path)
+	}
+
+	return &boltMessageQueueStore{db: db}, nil
+}
+
+type boltMessageQueueStore struct {
+	db *bolt.DB
+}
+
+func (s *boltMessageQueueStore) Append(record WALRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "marshaling message queue record")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messageQueueRecordsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(seqKey(seq), raw)
+	})
+}
+
+func (s *boltMessageQueueStore) LoadAll() ([]WALRecord, error) {
+	var records []WALRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messageQueueRecordsBucket)
+		return b.ForEach(func(_, raw []byte) error {
+			var record WALRecord
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return errors.Wrap(err, "decoding message queue record")
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *boltMessageQueueStore) Close() error {
+	return s.db.Close()
+}
+
+// seqKey encodes seq as a fixed-width, order-preserving big-endian key so a bucket cursor or
+// ForEach scan visits records in the order they were appended.
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,339 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-filecoin/address"
+	journaltesting "github.com/filecoin-project/go-filecoin/journal/testing"
+	"github.com/filecoin-project/go-filecoin/types"
+)
+
+// newTestAddress returns a new random address.Address for use as a message sender in tests.
+var newTestAddress = address.NewForTestGetter()
+
+// newTestMessage builds a minimal signed message for sender from, with the given nonce and gas
+// price, suitable for exercising MessageQueue without a real signer.
+func newTestMessage(from address.Address, nonce uint64, gasPrice int64) *types.SignedMessage {
+	return &types.SignedMessage{
+		Message: types.Message{
+			From:     from,
+			Nonce:    types.Uint64(nonce),
+			GasPrice: types.NewAttoFILFromFIL(gasPrice),
+		},
+	}
+}
+
+func newTestQueue(t *testing.T) *MessageQueue {
+	mq, err := NewMessageQueue(NewInMemoryMessageQueueStore(), ReplacePolicy{}, nil, QueueLimits{})
+	require.NoError(t, err)
+	return mq
+}
+
+func TestEnqueueWithUUIDIdempotent(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+	from := newTestAddress()
+	msg := newTestMessage(from, 0, 1)
+
+	require.NoError(t, mq.EnqueueWithUUID(ctx, msg, 1, "uuid-1"))
+	assert.Equal(t, int64(1), mq.Size())
+
+	// Resubmitting the same UUID while it is still queued is a no-op, not a nonce-gap error.
+	require.NoError(t, mq.EnqueueWithUUID(ctx, msg, 1, "uuid-1"))
+	assert.Equal(t, int64(1), mq.Size())
+
+	// Resubmitting the UUID after the message has already been removed (e.g. it landed in a
+	// block) is still recognized, rather than tripping the strict nonce check.
+	_, found, err := mq.RemoveNext(ctx, from, 0)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	require.NoError(t, mq.EnqueueWithUUID(ctx, msg, 1, "uuid-1"))
+	assert.Equal(t, int64(0), mq.Size(), "retried enqueue of an already-removed UUID must stay a no-op")
+}
+
+func TestMessageQueueReplaysStoreOnRestart(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryMessageQueueStore()
+	from := newTestAddress()
+
+	mq, err := NewMessageQueue(store, ReplacePolicy{}, nil, QueueLimits{})
+	require.NoError(t, err)
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 1), 1))
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 1, 1), 2))
+	_, found, err := mq.RemoveNext(ctx, from, 0)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	// Simulate a restart: a fresh MessageQueue over the same store must replay its WAL and end
+	// up with exactly the state the first queue had before "crashing".
+	restarted, err := NewMessageQueue(store, ReplacePolicy{}, nil, QueueLimits{})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), restarted.Size())
+	largest, found := restarted.LargestNonce(from)
+	assert.True(t, found)
+	assert.Equal(t, uint64(1), largest)
+}
+
+func TestBoltMessageQueueStoreReplaysAppendOrder(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	from := newTestAddress()
+
+	store, err := NewBoltMessageQueueStore(dir + "/mqueue.bolt")
+	require.NoError(t, err)
+
+	mq, err := NewMessageQueue(store, ReplacePolicy{}, nil, QueueLimits{})
+	require.NoError(t, err)
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 1), 1))
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 1, 1), 2))
+	require.NoError(t, mq.Close())
+	require.NoError(t, store.Close())
+
+	reopened, err := NewBoltMessageQueueStore(dir + "/mqueue.bolt")
+	require.NoError(t, err)
+	defer reopened.Close() // nolint: errcheck
+
+	restarted, err := NewMessageQueue(reopened, ReplacePolicy{}, nil, QueueLimits{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), restarted.Size())
+	largest, found := restarted.LargestNonce(from)
+	assert.True(t, found)
+	assert.Equal(t, uint64(1), largest)
+}
+
+func TestEnqueueReplaceByFeeThresholdMath(t *testing.T) {
+	ctx := context.Background()
+	policy := ReplacePolicy{AllowReplace: true, MinPriceBumpPercent: DefaultMinPriceBumpPercent}
+	mq, err := NewMessageQueue(NewInMemoryMessageQueueStore(), policy, nil, QueueLimits{})
+	require.NoError(t, err)
+	from := newTestAddress()
+
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 100), 1))
+
+	// A bump below the minimum is rejected outright.
+	err = mq.Enqueue(ctx, newTestMessage(from, 0, 124), 2)
+	require.Error(t, err)
+	list := mq.List(from)
+	require.Len(t, list, 1)
+	assert.Equal(t, int64(100), list[0].Msg.GasPrice.AsBigInt().Int64())
+
+	// A bump that clears the minimum is accepted, and the displaced message surfaces
+	// through ExpireBefore's return value rather than a separate drain API.
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 126), 3))
+	list = mq.List(from)
+	require.Len(t, list, 1)
+	assert.Equal(t, int64(126), list[0].Msg.GasPrice.AsBigInt().Int64())
+
+	expired := mq.ExpireBefore(ctx, 0)
+	require.Len(t, expired[from], 1)
+	assert.Equal(t, int64(100), expired[from][0].GasPrice.AsBigInt().Int64())
+}
+
+func TestPromoteBy(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+	from := newTestAddress()
+
+	// No queue yet for from: nothing to promote.
+	assert.False(t, mq.PromoteBy(from, types.NewAttoFILFromFIL(1).AsBigInt()))
+
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 100), 1))
+
+	assert.True(t, mq.PromoteBy(from, types.NewAttoFILFromFIL(100).AsBigInt()), "head gas premium at the floor must promote")
+	assert.True(t, mq.PromoteBy(from, types.NewAttoFILFromFIL(50).AsBigInt()), "head gas premium above the floor must promote")
+	assert.False(t, mq.PromoteBy(from, types.NewAttoFILFromFIL(101).AsBigInt()), "head gas premium below the floor must not promote")
+}
+
+func TestPending(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+	from := newTestAddress()
+
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 1), 1))
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 1, 1), 2))
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 2, 1), 3))
+
+	pending := mq.Pending(from)
+	require.Len(t, pending, 3)
+	for i, qm := range pending {
+		assert.Equal(t, uint64(i), uint64(qm.Msg.Nonce), "Pending must return messages in nonce order")
+	}
+}
+
+func TestReplacedMessagesDoNotReappearAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryMessageQueueStore()
+	policy := ReplacePolicy{AllowReplace: true, MinPriceBumpPercent: DefaultMinPriceBumpPercent}
+	from := newTestAddress()
+
+	mq, err := NewMessageQueue(store, policy, nil, QueueLimits{})
+	require.NoError(t, err)
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 100), 1))
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 126), 2))
+
+	// Drain and deliver the replacement before "crashing".
+	expired := mq.ExpireBefore(ctx, 0)
+	require.Len(t, expired[from], 1)
+
+	// Simulate a restart: replaying the same WAL must not resurrect a replacement that was
+	// already drained and delivered to a caller before the crash.
+	restarted, err := NewMessageQueue(store, policy, nil, QueueLimits{})
+	require.NoError(t, err)
+
+	reexpired := restarted.ExpireBefore(ctx, 0)
+	assert.Empty(t, reexpired[from], "a replacement already delivered before restart must not reappear")
+}
+
+func TestJournalDistinguishesRejectedEnqueue(t *testing.T) {
+	ctx := context.Background()
+	mj := journaltesting.NewMemoryJournal()
+	mq, err := NewMessageQueue(NewInMemoryMessageQueueStore(), ReplacePolicy{}, mj.Builder(), QueueLimits{})
+	require.NoError(t, err)
+	from := newTestAddress()
+
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 1), 1))
+
+	// A nonce-gap enqueue is rejected and must not be journaled under the same op as a
+	// successful enqueue, so a consumer filtering by op can tell the two apart.
+	err = mq.Enqueue(ctx, newTestMessage(from, 5, 1), 2)
+	require.Error(t, err)
+
+	var sawEnqueue, sawRejected bool
+	for _, rec := range mj.Records() {
+		switch rec.Operation {
+		case "enqueue":
+			sawEnqueue = true
+		case "enqueue_rejected":
+			sawRejected = true
+		}
+	}
+	assert.True(t, sawEnqueue, "successful enqueue must still be journaled as \"enqueue\"")
+	assert.True(t, sawRejected, "rejected enqueue must be journaled under a distinct op")
+}
+
+func TestEnqueueDoesNotEvictTheSenderJustAccepted(t *testing.T) {
+	ctx := context.Background()
+	limits := QueueLimits{MaxTotal: 2}
+	mq, err := NewMessageQueue(NewInMemoryMessageQueueStore(), ReplacePolicy{}, nil, limits)
+	require.NoError(t, err)
+
+	existing := newTestAddress()
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(existing, 0, 1), 10))
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(existing, 1, 1), 20))
+
+	// A brand-new sender's single message has the globally-oldest head stamp. Enqueue must still
+	// report success, and the message must actually be there to read back rather than having been
+	// evicted in the same call that accepted it.
+	newcomer := newTestAddress()
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(newcomer, 0, 1), 1))
+
+	list := mq.List(newcomer)
+	require.Len(t, list, 1, "the message just accepted for newcomer must not be evicted by its own enqueue")
+
+	// The limit is still enforced overall: evicting the existing sender's older queue instead
+	// brought the total back down to just the protected newcomer's message.
+	assert.Equal(t, int64(1), mq.Size())
+}
+
+func TestEvictedDeliversEvictedBatch(t *testing.T) {
+	ctx := context.Background()
+	limits := QueueLimits{MaxTotal: 1}
+	mq, err := NewMessageQueue(NewInMemoryMessageQueueStore(), ReplacePolicy{}, nil, limits)
+	require.NoError(t, err)
+
+	evictedSender := newTestAddress()
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(evictedSender, 0, 1), 1))
+
+	// Enqueuing a second sender with a newer stamp breaches MaxTotal and evicts evictedSender's
+	// entire queue, since it is not the sender just granted acceptance.
+	newcomer := newTestAddress()
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(newcomer, 0, 1), 2))
+
+	select {
+	case batch := <-mq.Evicted():
+		require.Len(t, batch, 1)
+		assert.Equal(t, evictedSender, batch[0].From)
+	default:
+		t.Fatal("expected an evicted batch to be delivered on Evicted()")
+	}
+}
+
+func TestStatsTotalBytesMatchesSerializedSize(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+	from := newTestAddress()
+
+	msg := newTestMessage(from, 0, 1)
+	raw, err := msg.Marshal()
+	require.NoError(t, err)
+
+	require.NoError(t, mq.Enqueue(ctx, msg, 7))
+
+	stats := mq.Stats()
+	assert.Equal(t, 1, stats.PerSender[from])
+	assert.Equal(t, uint64(7), stats.Oldest)
+	assert.Equal(t, uint64(7), stats.Newest)
+	assert.Equal(t, uint64(len(raw)), stats.TotalBytes)
+}
+
+func TestMaxPerSenderReturnsErrQueueFull(t *testing.T) {
+	ctx := context.Background()
+	limits := QueueLimits{MaxPerSender: 1}
+	mq, err := NewMessageQueue(NewInMemoryMessageQueueStore(), ReplacePolicy{}, nil, limits)
+	require.NoError(t, err)
+	from := newTestAddress()
+
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(from, 0, 1), 5))
+
+	err = mq.Enqueue(ctx, newTestMessage(from, 1, 1), 6)
+	require.Error(t, err)
+	full, ok := err.(*ErrQueueFull)
+	require.True(t, ok, "expected ErrQueueFull, got %T: %v", err, err)
+	assert.Equal(t, from, full.Sender)
+	assert.Equal(t, uint64(5), full.HeadStamp)
+}
+
+func TestMaxAgeStampsEvictsStaleSenders(t *testing.T) {
+	ctx := context.Background()
+	limits := QueueLimits{MaxAgeStamps: 10}
+	mq, err := NewMessageQueue(NewInMemoryMessageQueueStore(), ReplacePolicy{}, nil, limits)
+	require.NoError(t, err)
+
+	staleSender := newTestAddress()
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(staleSender, 0, 1), 1))
+
+	// A message stamped well beyond MaxAgeStamps past staleSender's head evicts it.
+	freshSender := newTestAddress()
+	require.NoError(t, mq.Enqueue(ctx, newTestMessage(freshSender, 0, 1), 20))
+
+	assert.Empty(t, mq.List(staleSender), "a sender older than MaxAgeStamps must be evicted")
+	assert.Len(t, mq.List(freshSender), 1)
+}
+
+func TestRecentUUIDRingEviction(t *testing.T) {
+	ctx := context.Background()
+	mq := newTestQueue(t)
+	from := newTestAddress()
+
+	// Enqueue and immediately remove more messages than recentUUIDWindow remembers, so the
+	// oldest UUID falls out of the ring.
+	for i := 0; i < recentUUIDWindow+1; i++ {
+		msg := newTestMessage(from, uint64(i), 1)
+		require.NoError(t, mq.EnqueueWithUUID(ctx, msg, uint64(i), fmt.Sprintf("uuid-%d", i)))
+		_, found, err := mq.RemoveNext(ctx, from, uint64(i))
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+
+	mq.lk.RLock()
+	ringLen := len(mq.recentUUIDs[from])
+	mq.lk.RUnlock()
+	assert.LessOrEqual(t, ringLen, recentUUIDWindow, "ring must never grow past recentUUIDWindow")
+}
@@ -1,12 +1,20 @@
 package journal
 
 import (
+	"time"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 type Journal interface {
 	Record(operation string, meta ...interface{})
+	// RecordAt is like Record, but stamps the entry with ts instead of the current time. This is
+	// used to replay historical events (e.g. rebuilding a journal from a write-ahead log) without
+	// losing when they actually happened.
+	RecordAt(ts time.Time, operation string, meta ...interface{})
+	// Close flushes any buffered entries. Callers should Close a Journal during graceful shutdown.
+	Close() error
 }
 
 type JournalBuilder func(topic string) (Journal, error)
@@ -28,15 +36,42 @@ func NewZapJournalBuilder(filepath string) JournalBuilder {
 			return nil, err
 		}
 		return &ZapJournal{
-			logger: journal.Sugar().Named(topic),
+			logger: journal.Named(topic),
 		}, nil
 	}
 }
 
 type ZapJournal struct {
-	logger *zap.SugaredLogger
+	logger *zap.Logger
 }
 
 func (zj *ZapJournal) Record(operation string, kv ...interface{}) {
-	zj.logger.Infow(operation, kv...)
+	zj.RecordAt(time.Now(), operation, kv...)
+}
+
+func (zj *ZapJournal) RecordAt(ts time.Time, operation string, kv ...interface{}) {
+	ce := zj.logger.Check(zapcore.InfoLevel, operation)
+	if ce == nil {
+		return
+	}
+	ce.Time = ts
+	ce.Write(sweetenFields(kv)...)
+}
+
+func (zj *ZapJournal) Close() error {
+	return zj.logger.Sync()
+}
+
+// sweetenFields converts a flat, alternating key/value list (as accepted by zap's SugaredLogger)
+// into the structured fields the underlying zap.Logger requires.
+func sweetenFields(kv []interface{}) []zap.Field {
+	fields := make([]zap.Field, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		fields = append(fields, zap.Any(key, kv[i+1]))
+	}
+	return fields
 }
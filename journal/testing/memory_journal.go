@@ -0,0 +1,64 @@
+package testing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-filecoin/journal"
+)
+
+// Record is a single entry captured by a MemoryJournal.
+type Record struct {
+	Time      time.Time
+	Operation string
+	Meta      []interface{}
+}
+
+// MemoryJournal is an in-memory journal.Journal implementation that captures every record in a
+// slice for assertions in unit tests, rather than writing to a real zap-backed log file.
+// MemoryJournal is safe for concurrent access.
+type MemoryJournal struct {
+	lk      sync.Mutex
+	records []Record
+}
+
+var _ journal.Journal = (*MemoryJournal)(nil)
+
+// NewMemoryJournal constructs a new, empty MemoryJournal.
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{}
+}
+
+// Builder returns a journal.JournalBuilder that always returns this MemoryJournal, regardless of
+// topic, so a test can inspect every recorded event from one place.
+func (mj *MemoryJournal) Builder() journal.JournalBuilder {
+	return func(topic string) (journal.Journal, error) {
+		return mj, nil
+	}
+}
+
+// Record appends operation and meta, stamped with the current time.
+func (mj *MemoryJournal) Record(operation string, meta ...interface{}) {
+	mj.RecordAt(time.Now(), operation, meta...)
+}
+
+// RecordAt appends operation and meta, stamped with ts.
+func (mj *MemoryJournal) RecordAt(ts time.Time, operation string, meta ...interface{}) {
+	mj.lk.Lock()
+	defer mj.lk.Unlock()
+	mj.records = append(mj.records, Record{Time: ts, Operation: operation, Meta: meta})
+}
+
+// Close is a no-op; MemoryJournal holds nothing that needs flushing.
+func (mj *MemoryJournal) Close() error {
+	return nil
+}
+
+// Records returns a copy of every record captured so far, in the order they were recorded.
+func (mj *MemoryJournal) Records() []Record {
+	mj.lk.Lock()
+	defer mj.lk.Unlock()
+	out := make([]Record, len(mj.records))
+	copy(out, mj.records)
+	return out
+}